@@ -0,0 +1,83 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"sync"
+)
+
+// CommitAsync runs a commit in the background and returns immediately. It's
+// meant for archive-node state commits, which can otherwise block
+// graceful shutdown for many seconds: the caller can cancel ctx to ask the
+// commit to wind down early, and poll the returned CommitHandle to surface
+// progress (e.g. in the RPC admin_* namespace) while it runs. Canceling stops
+// the walk from descending into more of the trie; it does not discard nodes
+// already produced before the cancellation was noticed - those still get
+// flushed to the database, so a canceled commit never leaves a node marked
+// clean in memory without actually having been persisted.
+//
+// The returned channel receives exactly one value - nil on success, or the
+// error that stopped the commit (including a canceled-context error) - and
+// is then closed. Until a value arrives on it, the trie must not be used
+// concurrently from another goroutine; the root is only swapped in after a
+// successful commit.
+func (t *Trie) CommitAsync(ctx context.Context, onleaf LeafCallback) (<-chan error, CommitHandle) {
+	if t.db == nil {
+		panic("commit called on trie with nil database")
+	}
+	h := newCommitterWithContext(ctx, onleaf)
+	h.progress = new(commitProgress)
+	handle := CommitHandle{progress: h.progress}
+
+	errCh := make(chan error, 1)
+	if t.root == nil {
+		h.onleaf = nil
+		returnCommitterToPool(h)
+		errCh <- nil
+		close(errCh)
+		return errCh, handle
+	}
+	t.Hash() // commit assumes all dirty nodes are already hashed, same as Commit
+
+	var wg sync.WaitGroup
+	if h.onleaf != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.commitLoop(t.db)
+		}()
+	}
+	go func() {
+		defer returnCommitterToPool(h)
+
+		newRoot, err := h.commit(t.root, t.db, true)
+		if h.leafCh != nil {
+			close(h.leafCh)
+			wg.Wait()
+		}
+		if err == nil {
+			err = h.err
+		}
+		if err == nil {
+			t.root = newRoot
+		}
+		errCh <- err
+		close(errCh)
+	}()
+	return errCh, handle
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestCommitAsyncMatchesCommit(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 200; i++ {
+		key := []byte{byte(i), byte(i >> 8)}
+		// 32-byte values keep each leaf too large to be embedded in its
+		// parent, so leaves are stored on their own and reach onleaf.
+		trie.Update(key, common.LeftPadBytes(key, 32))
+	}
+
+	want := trie.Copy()
+	wantRoot, err := want.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := trie.Copy()
+	var onleafCalls int64
+	onleaf := func(leaf []byte, parent common.Hash) error {
+		onleafCalls++
+		return nil
+	}
+	errCh, handle := got.CommitAsync(context.Background(), onleaf)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CommitAsync did not finish in time")
+	}
+	if got.Hash() != wantRoot {
+		t.Fatalf("root mismatch: got %x want %x", got.Hash(), wantRoot)
+	}
+	if handle.NodesCommitted() == 0 {
+		t.Fatal("expected at least one node committed")
+	}
+	if onleafCalls == 0 {
+		t.Fatal("expected onleaf to be invoked at least once, exercising the leafCh path")
+	}
+}
+
+func TestCommitAsyncCanceled(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 200; i++ {
+		key := []byte{byte(i), byte(i >> 8)}
+		trie.Update(key, key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	onleaf := func(leaf []byte, parent common.Hash) error { return nil }
+	errCh, _ := trie.CommitAsync(ctx, onleaf)
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected a cancellation error")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected wrapped context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CommitAsync did not finish in time")
+	}
+}
+
+// TestCommitAsyncCancelKeepsQueuedNodes cancels a large onleaf-driven commit
+// partway through and checks that every node handed to onleaf before
+// cancellation - i.e. already past commitLeaf's db.insert - actually landed
+// in the database. This is the leafCh/commitLoop path the request is about;
+// a regression here would mean a canceled commit can mark trie nodes clean
+// in memory without ever having persisted them.
+func TestCommitAsyncCancelKeepsQueuedNodes(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 5000; i++ {
+		key := []byte{byte(i), byte(i >> 8), byte(i >> 16)}
+		// 32-byte values keep each leaf too large to be embedded in its
+		// parent, so leaves are stored on their own and reach onleaf.
+		trie.Update(key, common.LeftPadBytes(key, 32))
+	}
+	trie.Hash()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var (
+		mu         sync.Mutex
+		seen       []common.Hash
+		cancelOnce sync.Once
+	)
+	onleaf := func(leaf []byte, parent common.Hash) error {
+		mu.Lock()
+		seen = append(seen, parent)
+		n := len(seen)
+		mu.Unlock()
+		if n == 50 {
+			cancelOnce.Do(cancel)
+		}
+		return nil
+	}
+
+	errCh, _ := trie.CommitAsync(ctx, onleaf)
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected the commit to observe the cancellation")
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected wrapped context.Canceled, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CommitAsync did not finish in time - commitLoop may be racing the producer")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) == 0 {
+		t.Fatal("expected onleaf to fire at least once before cancellation took effect")
+	}
+	for _, hash := range seen {
+		if _, err := trie.db.Node(hash); err != nil {
+			t.Fatalf("parent %x was handed to onleaf before cancellation but never landed in db: %v", hash, err)
+		}
+	}
+}
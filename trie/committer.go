@@ -17,12 +17,13 @@
 package trie
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/rlp"
 	"golang.org/x/crypto/sha3"
 )
 
@@ -32,10 +33,11 @@ const LeafChanSize = 200
 
 // Leaf represents a trie leaf value
 type Leaf struct {
-	size   int         // size of the rlp data (estimate)
+	size   int         // size of the rlp data (estimate, unless a sink is attached)
 	hash   common.Hash // hash of rlp data
 	node   node        // the node to commit
 	vnodes bool        // set to true if the node (possibly) contains a valueNode
+	rlp    []byte      // real RLP encoding of node, set only when a NodeSink is attached
 }
 
 // committer is a type used for the trie Commit operation. A committer has some
@@ -45,19 +47,66 @@ type Leaf struct {
 // By 'some level' of parallelism, it's still the case that all leaves will be
 // processed sequentially - onleaf will never be called in parallel or out of order.
 type committer struct {
-	tmp sliceBuffer
 	sha keccakState
+	enc encoder
 
 	onleaf LeafCallback
 	leafCh chan *Leaf
+
+	sink NodeSink // optional streaming destination, used instead of db when set
+	err  error    // first error returned by sink.Put, sticky for the life of the committer
+
+	ctx      context.Context // checked at every recursive commit step; nil means "never canceled"
+	progress *commitProgress // optional counters, updated as nodes are actually persisted
+}
+
+// commitProgress holds the atomic counters backing a CommitHandle. It
+// outlives the committer it was created for, since the handle may still be
+// read after the committer has been returned to committerPool.
+type commitProgress struct {
+	nodes int64
+	bytes int64
+}
+
+func (p *commitProgress) addNode(size int) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.nodes, 1)
+	atomic.AddInt64(&p.bytes, int64(size))
+}
+
+// CommitHandle lets a caller of Trie.CommitAsync poll the progress of a
+// commit that's running in the background. The zero CommitHandle reports
+// zero for both counters rather than panicking.
+type CommitHandle struct {
+	progress *commitProgress
+}
+
+// NodesCommitted returns the number of nodes persisted so far.
+func (h CommitHandle) NodesCommitted() int64 {
+	if h.progress == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&h.progress.nodes)
+}
+
+// BytesWritten returns the number of RLP bytes persisted so far. Note this
+// tracks the same size value store() uses for db accounting elsewhere in the
+// package: exact when a NodeSink is attached, an estimate otherwise.
+func (h CommitHandle) BytesWritten() int64 {
+	if h.progress == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&h.progress.bytes)
 }
 
 // committers live in a global db.
 var committerPool = sync.Pool{
 	New: func() interface{} {
 		return &committer{
-			tmp: make(sliceBuffer, 0, 550), // cap is as large as a full fullNode.
 			sha: sha3.NewLegacyKeccak256().(keccakState),
+			enc: encoder{buf: make(sliceBuffer, 0, 550)}, // cap is as large as a full fullNode.
 		}
 	},
 }
@@ -77,12 +126,49 @@ func newCommitter(onleaf LeafCallback) *committer {
 	return h
 }
 
+// newCommitterWithSink is like newCommitter, but routes stored nodes to sink
+// instead of a Database. It's used by Trie.CommitTo.
+func newCommitterWithSink(onleaf LeafCallback, sink NodeSink) *committer {
+	h := newCommitter(onleaf)
+	h.sink = sink
+	return h
+}
+
+// newCommitterWithContext is like newCommitter, but makes commit cancelable
+// via ctx; commitLoop still drains leafCh until it is closed. It's used by
+// Trie.CommitAsync.
+func newCommitterWithContext(ctx context.Context, onleaf LeafCallback) *committer {
+	h := newCommitter(onleaf)
+	h.ctx = ctx
+	return h
+}
+
 func returnCommitterToPool(h *committer) {
 	h.onleaf = nil
 	h.leafCh = nil
+	h.sink = nil
+	h.err = nil
+	h.ctx = nil
+	h.progress = nil
 	committerPool.Put(h)
 }
 
+// canceled reports whether h.ctx has been canceled, wrapping ctx.Err() so
+// callers can tell a canceled commit apart from other failures. A nil ctx
+// (the common case - plain Commit/CommitParallel/CommitTo never set one)
+// is never canceled.
+func (h *committer) canceled() error {
+	if h.ctx == nil {
+		return nil
+	}
+	select {
+	case <-h.ctx.Done():
+		return fmt.Errorf("trie: commit canceled: %w", h.ctx.Err())
+	default:
+		return nil
+	}
+}
+
 // commitNeeded returns 'false' if the given node is already in sync with db
 func (h *committer) commitNeeded(n node) bool {
 	hash, dirty := n.cache()
@@ -92,6 +178,9 @@ func (h *committer) commitNeeded(n node) bool {
 // hash collapses a node down into a hash node, also returning a copy of the
 // original node initialized with the computed hash to replace the original one.
 func (h *committer) commit(n node, db *Database, force bool) (node, error) {
+	if err := h.canceled(); err != nil {
+		return nil, err
+	}
 	// If we're not storing the node, just hashing, use available cached data
 	hash, dirty := n.cache()
 	if hash != nil && !dirty {
@@ -174,26 +263,39 @@ func (h *committer) store(n node, db *Database, force bool, hasVnodeChildren boo
 	var (
 		hash, _ = n.cache()
 		size    int
+		enc     []byte // real RLP encoding of n, only kept around when h.sink needs it
 	)
 	if hash == nil {
 		if vn, ok := n.(valueNode); ok {
-			h.tmp.Reset()
-			if err := rlp.Encode(&h.tmp, vn); err != nil {
-				panic("encode error: " + err.Error())
-			}
-			size = len(h.tmp)
+			h.enc.reset()
+			encoded := h.enc.encodeValue(vn)
+			size = len(encoded)
 			if size < 32 && !force {
 				return n // Nodes smaller than 32 bytes are stored inside their parent
 			}
-			hash = h.makeHashNode(h.tmp)
+			hash = h.makeHashNode(encoded)
+			if h.sink != nil {
+				// h.enc.buf is reused by the next store call on this committer,
+				// so the sink needs its own copy.
+				enc = append([]byte(nil), encoded...)
+			}
 		} else {
 			// This was not generated - must be a small node stored in the parent
 			// No need to do anything here
 			return n
 		}
+	} else if h.sink != nil {
+		// A streaming sink needs the node's real bytes, not an estimate, so
+		// downstream consumers don't have to re-encode it themselves.
+		enc = encodeNode(n)
+		size = len(enc)
 	} else {
-		// We have the hash already, estimate the RLP encoding-size of the node.
-		// The size is used for mem tracking, does not need to be exact
+		// We have the hash already, estimate the RLP encoding-size of the
+		// node. encodeNode would give an exact size, but it allocates fresh,
+		// non-pooled encoders at every recursion frame - worth paying for
+		// when a sink needs the actual bytes, wasteful when, as here,
+		// nothing downstream reads them and only the size (used for mem
+		// tracking) matters.
 		size = estimateSize(n)
 	}
 	// If we're using channel-based leaf-reporting, send to channel.
@@ -204,42 +306,71 @@ func (h *committer) store(n node, db *Database, force bool, hasVnodeChildren boo
 			hash:   common.BytesToHash(hash),
 			node:   n,
 			vnodes: hasVnodeChildren,
+			rlp:    enc,
+		}
+	} else if h.sink != nil {
+		if err := h.sink.Put(common.BytesToHash(hash), size, enc); err != nil && h.err == nil {
+			h.err = err
 		}
+		h.progress.addNode(size)
 	} else if db != nil {
 		// No leaf-callback used, but there's still a database. Do serial
 		// insertion
 		db.lock.Lock()
 		db.insert(common.BytesToHash(hash), size, n)
 		db.lock.Unlock()
+		h.progress.addNode(size)
 	}
 	return hash
 }
 
-// commitLoop does the actual insert + leaf callback for nodes
+// commitLoop does the actual insert + leaf callback for nodes. It always
+// drains leafCh until the producer closes it, including after h.ctx is
+// canceled: by the time commit() clears a node's dirty flag, that node has
+// already either been written out inline or handed to this loop via leafCh,
+// so leafCh must be fully drained for every such node to actually land in
+// db/sink. Cancellation is handled on the producer side instead - commit()
+// stops descending into the trie (and so stops sending) as soon as it
+// notices ctx is done, then closes leafCh once it unwinds - so this loop
+// still terminates promptly without racing the producer for the tail of the
+// channel.
 func (h *committer) commitLoop(db *Database) {
 	for item := range h.leafCh {
-		var (
-			hash      = item.hash
-			size      = item.size
-			n         = item.node
-			hasVnodes = item.vnodes
-		)
+		h.commitLeaf(db, item)
+	}
+}
+
+// commitLeaf performs the insert + leaf callback for a single leaf pulled off
+// leafCh.
+func (h *committer) commitLeaf(db *Database, item *Leaf) {
+	var (
+		hash      = item.hash
+		size      = item.size
+		n         = item.node
+		hasVnodes = item.vnodes
+	)
+	if h.sink != nil {
+		if err := h.sink.Put(hash, size, item.rlp); err != nil && h.err == nil {
+			h.err = err
+		}
+	} else {
 		// We are pooling the trie nodes into an intermediate memory cache
 		db.lock.Lock()
 		db.insert(hash, size, n)
 		db.lock.Unlock()
-		if h.onleaf != nil && hasVnodes {
-			switch n := n.(type) {
-			case *shortNode:
-				if child, ok := n.Val.(valueNode); ok {
+	}
+	h.progress.addNode(size)
+	if h.onleaf != nil && hasVnodes {
+		switch n := n.(type) {
+		case *shortNode:
+			if child, ok := n.Val.(valueNode); ok {
+				h.onleaf(child, hash)
+			}
+		case *fullNode:
+			for i := 0; i < 16; i++ {
+				if child, ok := n.Children[i].(valueNode); ok {
 					h.onleaf(child, hash)
 				}
-			case *fullNode:
-				for i := 0; i < 16; i++ {
-					if child, ok := n.Children[i].(valueNode); ok {
-						h.onleaf(child, hash)
-					}
-				}
 			}
 		}
 	}
@@ -0,0 +1,205 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// CommitParallel is a variant of Commit that, when the root of the trie is a
+// fullNode, fans the commit of its (up to 16) children out across a bounded
+// pool of workers instead of walking them one at a time. It is meant for
+// large account tries, where the serial recursion in Commit is the
+// bottleneck.
+//
+// workers caps the number of goroutines used to commit child subtrees
+// concurrently; a value <= 1 (or a root that isn't a *fullNode) falls back to
+// the plain Commit. If workers is larger than GOMAXPROCS, it's capped there,
+// since the work is CPU-bound hashing and copying, not I/O.
+//
+// As with Commit, onleaf is invoked once per leaf, in the same left-to-right
+// order a serial commit would produce - the parallelism only applies to the
+// subtree walk, never to the leaf callback.
+func (t *Trie) CommitParallel(onleaf LeafCallback, workers int) (root common.Hash, err error) {
+	if t.db == nil {
+		panic("commit called on trie with nil database")
+	}
+	if t.root == nil {
+		return emptyRoot, nil
+	}
+	t.Hash() // commit assumes all dirty nodes are already hashed, same as Commit
+	rootFull, ok := t.root.(*fullNode)
+	if !ok || workers <= 1 {
+		return t.Commit(onleaf)
+	}
+	if max := runtime.GOMAXPROCS(0); workers > max {
+		workers = max
+	}
+
+	h := newCommitter(onleaf)
+	defer returnCommitterToPool(h)
+
+	// A single goroutine drains the shared leafCh and performs the actual
+	// db.insert + onleaf dispatch, so leaves are still processed - and
+	// onleaf still invoked - strictly sequentially.
+	var drain sync.WaitGroup
+	if h.leafCh != nil {
+		drain.Add(1)
+		go func() {
+			defer drain.Done()
+			h.commitLoop(t.db)
+		}()
+	}
+
+	collapsed := rootFull.copy()
+	children, hasVnodes, err := h.commitChildrenParallel(rootFull, t.db, false, workers)
+	if err != nil {
+		if h.leafCh != nil {
+			close(h.leafCh)
+			drain.Wait()
+		}
+		return common.Hash{}, err
+	}
+	collapsed.Children = children
+
+	newRoot := h.store(collapsed, t.db, true, hasVnodes)
+	if h.leafCh != nil {
+		close(h.leafCh)
+		drain.Wait()
+	}
+
+	t.root = newRoot
+	if hn, ok := newRoot.(hashNode); ok {
+		return common.BytesToHash(hn), nil
+	}
+	// Root collapsed into something smaller than a hash (only possible for
+	// a nearly-empty trie); hash it the regular way to get the root hash.
+	hash, cached, _ := t.hashRoot(nil, nil)
+	t.root = cached
+	return common.BytesToHash(hash.(hashNode)), nil
+}
+
+// commitChildrenParallel is like commitChildren, but spreads the commit of
+// each non-nil child across up to `workers` goroutines. Each worker borrows
+// its own *committer from the shared pool - so it gets its own scratch `sha`
+// and `enc` encoder - and commits into a private leafCh of its own, rather
+// than the parent's. That's necessary to preserve the "onleaf is never
+// invoked out of order" guarantee Commit makes: if every worker fed the
+// shared leafCh directly, leaves would arrive at commitLoop in whatever
+// order goroutines happen to finish in, not the left-to-right order a serial
+// commit produces. Instead, each worker's leaves are collected in the order
+// that one committer produces them - which, for a single child's subtree,
+// is the same order the serial path would - and once every worker is done,
+// they're replayed into h's real leafCh one child at a time, in ascending
+// index order. commitLoop (and onleaf) only ever sees that single, ordered
+// stream, at the cost of holding a child's leaves in memory until its
+// sibling workers have also finished. db.lock is only ever held for the
+// duration of db.insert, same as the serial path.
+func (h *committer) commitChildrenParallel(n *fullNode, db *Database, force bool, workers int) ([17]node, bool, error) {
+	var (
+		children             [17]node
+		hasValueNodeChildren bool
+		leavesByChild        [17][]*Leaf
+		sem                  = make(chan struct{}, workers)
+		wg                   sync.WaitGroup
+		mu                   sync.Mutex
+		firstErr             error
+	)
+	for i, child := range n.Children {
+		if child == nil {
+			continue
+		}
+		i, child := i, child
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			w := committerPool.Get().(*committer)
+			w.sink = h.sink
+			w.ctx = h.ctx
+			w.progress = h.progress
+
+			// Give the worker its own leafCh (only needed when the parent
+			// actually has an onleaf callback) so its leaves can't interleave
+			// with another worker's on the shared channel; a private
+			// goroutine collects them, in order, into a plain slice.
+			var leaves []*Leaf
+			var collect sync.WaitGroup
+			if h.leafCh != nil {
+				w.leafCh = make(chan *Leaf, LeafChanSize)
+				collect.Add(1)
+				go func() {
+					defer collect.Done()
+					for leaf := range w.leafCh {
+						leaves = append(leaves, leaf)
+					}
+				}()
+			}
+
+			hnode, err := w.commit(child, db, force)
+			sinkErr := w.err
+			if w.leafCh != nil {
+				close(w.leafCh)
+				collect.Wait()
+			}
+
+			w.leafCh = nil
+			w.sink = nil
+			w.ctx = nil
+			w.progress = nil
+			w.err = nil
+			committerPool.Put(w)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				err = sinkErr
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			children[i] = hnode
+			leavesByChild[i] = leaves
+			if _, ok := hnode.(valueNode); ok {
+				hasValueNodeChildren = true
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return children, false, firstErr
+	}
+	// Replay every child's leaves into h's own leafCh in ascending child
+	// index order, so the single commitLoop draining it - and onleaf -
+	// see exactly the order a serial commit would have produced.
+	if h.leafCh != nil {
+		for _, leaves := range leavesByChild {
+			for _, leaf := range leaves {
+				h.leafCh <- leaf
+			}
+		}
+	}
+	return children, hasValueNodeChildren, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// makeLargeTrie builds an account-trie-shaped trie with n leaves, hashed but
+// not yet committed, for use in the CommitParallel benchmarks below.
+func makeLargeTrie(n int) *Trie {
+	trie := newEmpty()
+	var key [32]byte
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(key[24:], uint64(i))
+		trie.Update(key[:], key[:])
+	}
+	trie.Hash()
+	return trie
+}
+
+// TestCommitParallelMatchesCommit checks that CommitParallel, run with
+// several different worker counts, produces the same root hash as a serial
+// Commit on the same trie content.
+func TestCommitParallelMatchesCommit(t *testing.T) {
+	trie := makeLargeTrie(2000)
+
+	want := trie.Copy()
+	wantRoot, err := want.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{2, 4, 8, 16} {
+		got := trie.Copy()
+		gotRoot, err := got.CommitParallel(nil, workers)
+		if err != nil {
+			t.Fatalf("workers=%d: %v", workers, err)
+		}
+		if gotRoot != wantRoot {
+			t.Fatalf("workers=%d: root mismatch: got %x want %x", workers, gotRoot, wantRoot)
+		}
+	}
+}
+
+// TestCommitParallelLeafOrder checks that CommitParallel still invokes onleaf
+// in the same left-to-right order a serial Commit would, despite committing
+// sibling subtrees concurrently. A regression here would silently break any
+// onleaf consumer that relies on that ordering (e.g. snapshot generation).
+func TestCommitParallelLeafOrder(t *testing.T) {
+	trie := makeLargeTrie(2000)
+
+	recordOnleaf := func() (LeafCallback, *[]common.Hash) {
+		var (
+			mu   sync.Mutex
+			seen []common.Hash
+		)
+		return func(leaf []byte, parent common.Hash) error {
+			mu.Lock()
+			seen = append(seen, parent)
+			mu.Unlock()
+			return nil
+		}, &seen
+	}
+
+	wantOnleaf, wantSeen := recordOnleaf()
+	want := trie.Copy()
+	if _, err := want.Commit(wantOnleaf); err != nil {
+		t.Fatal(err)
+	}
+
+	gotOnleaf, gotSeen := recordOnleaf()
+	got := trie.Copy()
+	if _, err := got.CommitParallel(gotOnleaf, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*gotSeen) == 0 {
+		t.Fatal("expected onleaf to be invoked at least once")
+	}
+	if len(*gotSeen) != len(*wantSeen) {
+		t.Fatalf("onleaf call count mismatch: got %d want %d", len(*gotSeen), len(*wantSeen))
+	}
+	for i := range *wantSeen {
+		if (*gotSeen)[i] != (*wantSeen)[i] {
+			t.Fatalf("onleaf order mismatch at index %d: got %x want %x", i, (*gotSeen)[i], (*wantSeen)[i])
+		}
+	}
+}
+
+func benchmarkCommit(b *testing.B, leaves int, workers int) {
+	trie := makeLargeTrie(leaves)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clone := trie.Copy()
+		if workers <= 1 {
+			clone.Commit(nil)
+		} else {
+			clone.CommitParallel(nil, workers)
+		}
+	}
+}
+
+func BenchmarkCommit1MSerial(b *testing.B)     { benchmarkCommit(b, 1_000_000, 1) }
+func BenchmarkCommit1MParallel2(b *testing.B)  { benchmarkCommit(b, 1_000_000, 2) }
+func BenchmarkCommit1MParallel4(b *testing.B)  { benchmarkCommit(b, 1_000_000, 4) }
+func BenchmarkCommit1MParallel8(b *testing.B)  { benchmarkCommit(b, 1_000_000, 8) }
+func BenchmarkCommit1MParallel16(b *testing.B) { benchmarkCommit(b, 1_000_000, 16) }
@@ -0,0 +1,191 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import "fmt"
+
+// encoder produces the RLP encoding of the handful of shapes a trie node can
+// take - short nodes, full nodes, raw values and hashes - by writing directly
+// into a reused sliceBuffer, instead of going through the reflection-based
+// rlp.Encode. Every node encodes down to a flat list of already-encoded
+// pieces, so encoder never needs to reflect on a value's type: callers hand
+// it the raw bytes (or the previously-encoded RLP of a child) and it only
+// has to frame them with the right string/list header.
+//
+// An encoder is not safe for concurrent use. It is embedded in committer (one
+// per pooled instance) and reset before every node it encodes.
+type encoder struct {
+	buf sliceBuffer // accumulated output, reused across calls via reset
+	tmp [9]byte     // scratch for big-endian length headers
+}
+
+// reset clears the encoder's output buffer for reuse.
+func (e *encoder) reset() {
+	e.buf = e.buf[:0]
+}
+
+// encodeValue appends the RLP string encoding of a leaf value to e.buf and
+// returns the full buffer.
+func (e *encoder) encodeValue(val []byte) []byte {
+	e.appendString(val)
+	return e.buf
+}
+
+// encodeHash appends the RLP string encoding of a node hash to e.buf and
+// returns the full buffer. Hashes are always 32 bytes, but the helper
+// doesn't assume that, since hashNode is just a []byte under the hood.
+func (e *encoder) encodeHash(hash []byte) []byte {
+	e.appendString(hash)
+	return e.buf
+}
+
+// encodeShort appends the RLP encoding of a shortNode to e.buf and returns the
+// full buffer. key must already be hex-to-compact converted; val must already
+// be the RLP encoding of the node's value (e.g. as produced by encodeValue,
+// encodeHash, or a nested encodeFull/encodeShort).
+func (e *encoder) encodeShort(key []byte, val []byte) []byte {
+	var keyBuf sliceBuffer
+	keyBuf = appendString(keyBuf, key)
+	e.appendListHeader(len(keyBuf) + len(val))
+	e.buf = append(e.buf, keyBuf...)
+	e.buf = append(e.buf, val...)
+	return e.buf
+}
+
+// encodeFull appends the RLP encoding of a fullNode to e.buf and returns the
+// full buffer. children holds the already-encoded RLP of each of the 17
+// slots; a nil entry encodes as the empty string, same as rlp.Encode would
+// produce for a nil node.
+func (e *encoder) encodeFull(children [17][]byte) []byte {
+	size := 0
+	for _, c := range children {
+		if c == nil {
+			size++ // empty string header, 0x80
+		} else {
+			size += len(c)
+		}
+	}
+	e.appendListHeader(size)
+	for _, c := range children {
+		if c == nil {
+			e.buf = append(e.buf, 0x80)
+		} else {
+			e.buf = append(e.buf, c...)
+		}
+	}
+	return e.buf
+}
+
+// appendString appends the RLP string encoding of b to e.buf.
+func (e *encoder) appendString(b []byte) {
+	e.buf = appendString(e.buf, b)
+}
+
+// appendListHeader appends an RLP list header for a payload of the given
+// size to e.buf.
+func (e *encoder) appendListHeader(size int) {
+	e.buf = appendHeader(e.buf, 0xc0, size, e.tmp[:])
+}
+
+// encodeNode returns the full RLP encoding of n, recursing into any child
+// that isn't already a hash or a value - which happens whenever a child was
+// small enough to be inlined into its parent instead of hashed separately.
+// When a sink is attached, it's what committer.store uses to size and
+// publish every already-hashed node it's handed; without a sink, store
+// estimates the size with estimateSize instead.
+func encodeNode(n node) []byte {
+	switch n := n.(type) {
+	case *shortNode:
+		var e encoder
+		return e.encodeShort(n.Key, encodeNode(n.Val))
+	case *fullNode:
+		var children [17][]byte
+		for i, c := range n.Children {
+			if c != nil {
+				children[i] = encodeNode(c)
+			}
+		}
+		var e encoder
+		return e.encodeFull(children)
+	case valueNode:
+		var e encoder
+		return e.encodeValue(n)
+	case hashNode:
+		var e encoder
+		return e.encodeHash(n)
+	default:
+		panic(fmt.Sprintf("trie: cannot encode node of type %T", n))
+	}
+}
+
+// appendString appends the RLP string encoding of b to buf and returns the
+// extended slice. A single byte below 0x80 encodes as itself, matching the
+// RLP short-string special case.
+func appendString(buf sliceBuffer, b []byte) sliceBuffer {
+	if len(b) == 1 && b[0] < 0x80 {
+		return append(buf, b[0])
+	}
+	var tmp [9]byte
+	buf = appendHeader(buf, 0x80, len(b), tmp[:])
+	return append(buf, b...)
+}
+
+// appendHeader appends an RLP length header (string if offset is 0x80, list
+// if offset is 0xc0) for a payload of the given size. tmp is scratch space of
+// at least 9 bytes, used to build the big-endian long-form length.
+func appendHeader(buf sliceBuffer, offset byte, size int, tmp []byte) sliceBuffer {
+	if size < 56 {
+		return append(buf, offset+byte(size))
+	}
+	n := putBigEndian(tmp, uint64(size))
+	buf = append(buf, offset+55+byte(n))
+	return append(buf, tmp[:n]...)
+}
+
+// putBigEndian writes the minimal big-endian representation of v into buf
+// and returns the number of bytes written.
+func putBigEndian(buf []byte, v uint64) int {
+	switch {
+	case v < (1 << 8):
+		buf[0] = byte(v)
+		return 1
+	case v < (1 << 16):
+		buf[0] = byte(v >> 8)
+		buf[1] = byte(v)
+		return 2
+	case v < (1 << 24):
+		buf[0] = byte(v >> 16)
+		buf[1] = byte(v >> 8)
+		buf[2] = byte(v)
+		return 3
+	case v < (1 << 32):
+		buf[0] = byte(v >> 24)
+		buf[1] = byte(v >> 16)
+		buf[2] = byte(v >> 8)
+		buf[3] = byte(v)
+		return 4
+	default:
+		n := 5
+		for n < 8 && v>>(8*uint(n)) != 0 {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			buf[i] = byte(v >> (8 * uint(n-1-i)))
+		}
+		return n
+	}
+}
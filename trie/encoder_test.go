@@ -0,0 +1,133 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestEncoderMatchesRLP(t *testing.T) {
+	val := []byte("a representative 40-byte leaf value!!!!!")
+	hash := make([]byte, 32)
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+
+	var e encoder
+	got := e.encodeValue(val)
+
+	var want bytes.Buffer
+	if err := rlp.Encode(&want, val); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("encodeValue mismatch:\ngot  %x\nwant %x", got, want.Bytes())
+	}
+
+	e.reset()
+	got = e.encodeHash(hash)
+	want.Reset()
+	if err := rlp.Encode(&want, hash); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("encodeHash mismatch:\ngot  %x\nwant %x", got, want.Bytes())
+	}
+}
+
+// TestEncodeShortMatchesRLP checks encodeShort's list-header arithmetic
+// against rlp.Encode, for both a short (<56 byte payload) and a long
+// (>=56 byte payload) shortNode, since the two take different header forms.
+func TestEncodeShortMatchesRLP(t *testing.T) {
+	for _, val := range [][]byte{
+		[]byte("short value"),
+		bytes.Repeat([]byte{0xab}, 80), // pushes the list payload past 55 bytes
+	} {
+		key := hexToCompact([]byte{1, 2, 3, 4, 5})
+		rawVal := rlp.RawValue(appendString(nil, val))
+
+		var e encoder
+		got := e.encodeShort(key, rawVal)
+
+		var want bytes.Buffer
+		if err := rlp.Encode(&want, []interface{}{key, rawVal}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Fatalf("encodeShort(len(val)=%d) mismatch:\ngot  %x\nwant %x", len(val), got, want.Bytes())
+		}
+	}
+}
+
+// TestEncodeFullMatchesRLP checks encodeFull's list-header arithmetic against
+// rlp.Encode for both a sparse fullNode (<56 byte payload) and one with every
+// slot filled with a 32-byte hash (>=56 byte payload).
+func TestEncodeFullMatchesRLP(t *testing.T) {
+	sparse := [17][]byte{}
+	sparse[3] = rlp.RawValue(appendString(nil, []byte("v")))
+
+	full := [17][]byte{}
+	for i := 0; i < 16; i++ {
+		hash := make([]byte, 32)
+		hash[0] = byte(i)
+		full[i] = rlp.RawValue(appendString(nil, hash))
+	}
+
+	for _, children := range [][17][]byte{sparse, full} {
+		var e encoder
+		got := e.encodeFull(children)
+
+		list := make([]interface{}, 17)
+		for i, c := range children {
+			if c == nil {
+				list[i] = rlp.RawValue{0x80}
+			} else {
+				list[i] = rlp.RawValue(c)
+			}
+		}
+		var want bytes.Buffer
+		if err := rlp.Encode(&want, list); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Fatalf("encodeFull mismatch:\ngot  %x\nwant %x", got, want.Bytes())
+		}
+	}
+}
+
+func BenchmarkEncodeValueEncoder(b *testing.B) {
+	val := make([]byte, 32)
+	var e encoder
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		e.reset()
+		e.encodeValue(val)
+	}
+}
+
+func BenchmarkEncodeValueRLP(b *testing.B) {
+	val := make([]byte, 32)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		rlp.Encode(&buf, val)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NodeSink receives trie nodes as they're committed, in the same order
+// Commit would otherwise write them to a Database. rlp is the already-encoded
+// RLP of the node; implementations that just persist bytes (a leveldb.Batch,
+// an io.Writer) can write it through as-is without re-encoding.
+//
+// Put must not retain rlp beyond the call.
+type NodeSink interface {
+	Put(hash common.Hash, size int, rlp []byte) error
+}
+
+// Put implements NodeSink by storing the node in the database under its hash,
+// the same way the in-memory Commit path does. This lets Database itself be
+// passed to CommitTo wherever a NodeSink is expected.
+func (db *Database) Put(hash common.Hash, size int, rlp []byte) error {
+	db.lock.Lock()
+	db.insert(hash, size, rawNode(common.CopyBytes(rlp)))
+	db.lock.Unlock()
+	return nil
+}
+
+// WriterNodeSink adapts an io.Writer into a NodeSink by emitting each node as
+// a length-prefixed record: the 32-byte hash, a big-endian uint32 RLP length,
+// then the RLP bytes themselves. It's meant for snapshot export, where the
+// consumer on the other end just wants a flat stream of (hash, rlp) pairs
+// without paying for an intermediate Database.
+type WriterNodeSink struct {
+	w io.Writer
+}
+
+// NewWriterNodeSink returns a NodeSink that streams nodes to w.
+func NewWriterNodeSink(w io.Writer) *WriterNodeSink {
+	return &WriterNodeSink{w: w}
+}
+
+func (s *WriterNodeSink) Put(hash common.Hash, size int, data []byte) error {
+	var lenBuf [4]byte
+	putUint32(lenBuf[:], uint32(len(data)))
+	if _, err := s.w.Write(hash[:]); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(data)
+	return err
+}
+
+func putUint32(buf []byte, v uint32) {
+	buf[0] = byte(v >> 24)
+	buf[1] = byte(v >> 16)
+	buf[2] = byte(v >> 8)
+	buf[3] = byte(v)
+}
+
+// CommitTo is a streaming variant of Commit: instead of writing dirty nodes
+// into an in-memory Database, it feeds the already-encoded RLP of each node
+// straight to sink as it's produced. This lets the whole dirty subtree be
+// pushed to disk (or onto the wire, for snapshot-sync producers) without ever
+// being retained in the Database's dirty-node cache.
+//
+// onleaf behaves exactly as it does for Commit.
+func (t *Trie) CommitTo(sink NodeSink, onleaf LeafCallback) (root common.Hash, err error) {
+	if t.db == nil {
+		panic("commit called on trie with nil database")
+	}
+	if t.root == nil {
+		return emptyRoot, nil
+	}
+	t.Hash() // commit assumes all dirty nodes are already hashed, same as Commit
+	h := newCommitterWithSink(onleaf, sink)
+	defer returnCommitterToPool(h)
+
+	var wg sync.WaitGroup
+	if h.onleaf != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.commitLoop(nil)
+		}()
+	}
+	newRoot, err := h.commit(t.root, t.db, true)
+	if h.leafCh != nil {
+		close(h.leafCh)
+		wg.Wait()
+	}
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if h.err != nil {
+		return common.Hash{}, h.err
+	}
+	t.root = newRoot
+	return common.BytesToHash(newRoot.(hashNode)), nil
+}
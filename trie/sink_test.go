@@ -0,0 +1,86 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// memSink is a trivial NodeSink that just keeps everything it's given, for
+// use in tests.
+type memSink struct {
+	nodes map[common.Hash][]byte
+}
+
+func newMemSink() *memSink {
+	return &memSink{nodes: make(map[common.Hash][]byte)}
+}
+
+func (s *memSink) Put(hash common.Hash, size int, rlp []byte) error {
+	s.nodes[hash] = append([]byte(nil), rlp...)
+	return nil
+}
+
+func TestCommitToMatchesCommit(t *testing.T) {
+	trie := newEmpty()
+	for i := 0; i < 200; i++ {
+		key := []byte{byte(i), byte(i >> 8)}
+		trie.Update(key, key)
+	}
+
+	want := trie.Copy()
+	wantRoot, err := want.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newMemSink()
+	got := trie.Copy()
+	gotRoot, err := got.CommitTo(sink, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotRoot != wantRoot {
+		t.Fatalf("root mismatch: got %x want %x", gotRoot, wantRoot)
+	}
+	if len(sink.nodes) == 0 {
+		t.Fatal("expected sink to receive at least the root node")
+	}
+	if _, ok := sink.nodes[wantRoot]; !ok {
+		t.Fatal("sink never received the root node")
+	}
+}
+
+func TestWriterNodeSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterNodeSink(&buf)
+
+	hash := common.HexToHash("0x01")
+	data := []byte("hello world")
+	if err := sink.Put(hash, len(data), data); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.Len(), common.HashLength+4+len(data); got != want {
+		t.Fatalf("wrote %d bytes, want %d", got, want)
+	}
+	if !bytes.Equal(buf.Bytes()[:common.HashLength], hash[:]) {
+		t.Fatal("hash not written first")
+	}
+}